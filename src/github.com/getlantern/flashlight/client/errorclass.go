@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errorReasonHeader carries the classified reason (see upstreamErrorClass)
+// on our own error responses. status.ErrorAccessingPage has no way to embed
+// it in the rendered HTML itself, so anything wanting to show the user (or
+// an extension, or the desktop UI's network inspector) something more
+// actionable than "site unavailable" can read it from here instead.
+const errorReasonHeader = "X-Lantern-Error-Reason"
+
+// upstreamErrorClass describes how we classify a failed RoundTrip: the HTTP
+// status code that best represents it to the browser, and a short,
+// stable reason string for logging/counters.
+type upstreamErrorClass struct {
+	status int
+	reason string
+}
+
+var (
+	classGatewayTimeout = upstreamErrorClass{http.StatusGatewayTimeout, "gateway_timeout"}
+	classBadGateway     = upstreamErrorClass{http.StatusBadGateway, "bad_gateway"}
+	classUnavailable    = upstreamErrorClass{http.StatusServiceUnavailable, "unavailable"}
+)
+
+// badGatewaySubstrings are matched against err.Error() to catch the dial and
+// handshake failures that don't implement net.Error, or whose Timeout()
+// would otherwise be false.
+var badGatewaySubstrings = []string{
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"tls: ",
+	"unexpected EOF",
+	"EOF",
+}
+
+// classifyUpstreamError maps the error returned by a RoundTrip attempt to
+// the HTTP status code and reason that best describes why it failed, so we
+// stop collapsing every failure into a generic 503.
+func classifyUpstreamError(err error) upstreamErrorClass {
+	if err == context.DeadlineExceeded {
+		return classGatewayTimeout
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return classGatewayTimeout
+	}
+
+	msg := err.Error()
+	for _, substr := range badGatewaySubstrings {
+		if strings.Contains(msg, substr) {
+			return classBadGateway
+		}
+	}
+
+	return classUnavailable
+}
+
+// errorClassCounts tracks how many times we've classified a RoundTrip
+// failure into each reason, so the client can surface it for diagnostics.
+var errorClassCounts = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: make(map[string]int64)}
+
+func recordErrorClass(class upstreamErrorClass) {
+	errorClassCounts.Lock()
+	errorClassCounts.counts[class.reason]++
+	errorClassCounts.Unlock()
+}
+
+// ErrorClassCounts returns a snapshot of how many times each upstream
+// failure class ("gateway_timeout", "bad_gateway", "unavailable") has been
+// observed since startup.
+func ErrorClassCounts() map[string]int64 {
+	errorClassCounts.Lock()
+	defer errorClassCounts.Unlock()
+
+	snapshot := make(map[string]int64, len(errorClassCounts.counts))
+	for reason, count := range errorClassCounts.counts {
+		snapshot[reason] = count
+	}
+	return snapshot
+}
+
+// UpstreamError wraps a RoundTrip failure together with its classification,
+// so that a Client.ErrorHandler hook can pick behavior per failure class
+// without re-deriving it from the raw error.
+type UpstreamError struct {
+	Err        error
+	Reason     string
+	StatusCode int
+}
+
+func (e *UpstreamError) Error() string { return e.Err.Error() }
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// newUpstreamError classifies err, records it in ErrorClassCounts, and
+// returns it wrapped as an *UpstreamError.
+func newUpstreamError(err error) *UpstreamError {
+	class := classifyUpstreamError(err)
+	recordErrorClass(class)
+	return &UpstreamError{Err: err, Reason: class.reason, StatusCode: class.status}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type fakeTimeoutError struct{ timeout bool }
+
+func (e *fakeTimeoutError) Error() string   { return "fake net error" }
+func (e *fakeTimeoutError) Timeout() bool   { return e.timeout }
+func (e *fakeTimeoutError) Temporary() bool { return false }
+
+func TestClassifyUpstreamError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantReason string
+	}{
+		{"context deadline exceeded", context.DeadlineExceeded, http.StatusGatewayTimeout, "gateway_timeout"},
+		{"net.Error timeout", &fakeTimeoutError{timeout: true}, http.StatusGatewayTimeout, "gateway_timeout"},
+		{"connection refused", errors.New("dial tcp 1.2.3.4:443: connect: connection refused"), http.StatusBadGateway, "bad_gateway"},
+		{"connection reset", errors.New("read: connection reset by peer"), http.StatusBadGateway, "bad_gateway"},
+		{"dns failure", errors.New("lookup example.com: no such host"), http.StatusBadGateway, "bad_gateway"},
+		{"tls handshake failure", errors.New("tls: handshake failure"), http.StatusBadGateway, "bad_gateway"},
+		{"eof before headers", errors.New("unexpected EOF"), http.StatusBadGateway, "bad_gateway"},
+		{"unrecognized error", errors.New("something else entirely"), http.StatusServiceUnavailable, "unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := classifyUpstreamError(tt.err)
+			if class.status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", class.status, tt.wantStatus)
+			}
+			if class.reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", class.reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+var _ net.Error = (*fakeTimeoutError)(nil)
+
+func TestRecordErrorClassIncrementsCounter(t *testing.T) {
+	before := ErrorClassCounts()["bad_gateway"]
+
+	recordErrorClass(classBadGateway)
+
+	after := ErrorClassCounts()["bad_gateway"]
+	if after != before+1 {
+		t.Fatalf("expected bad_gateway count to increase by 1, went from %d to %d", before, after)
+	}
+}
+
+func TestNewUpstreamErrorWrapsAndClassifies(t *testing.T) {
+	orig := errors.New("connection refused")
+	uerr := newUpstreamError(orig)
+
+	if uerr.Err != orig {
+		t.Errorf("Err = %v, want %v", uerr.Err, orig)
+	}
+	if uerr.Reason != "bad_gateway" {
+		t.Errorf("Reason = %q, want %q", uerr.Reason, "bad_gateway")
+	}
+	if uerr.StatusCode != http.StatusBadGateway {
+		t.Errorf("StatusCode = %d, want %d", uerr.StatusCode, http.StatusBadGateway)
+	}
+	if uerr.Error() != orig.Error() {
+		t.Errorf("Error() = %q, want %q", uerr.Error(), orig.Error())
+	}
+	if uerr.Unwrap() != orig {
+		t.Errorf("Unwrap() = %v, want %v", uerr.Unwrap(), orig)
+	}
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	retryInitialInterval     = 500 * time.Millisecond
+	retryMultiplier          = 1.5
+	retryRandomizationFactor = 0.5
+	retryMaxInterval         = 60 * time.Second
+	retryMaxElapsedTime      = 30 * time.Second
+	maxRetries               = 4
+)
+
+// retryableMethods are the HTTP methods we'll retry regardless of whether
+// the request has a body, since re-sending them can't have a side effect
+// beyond what the first attempt already would have.
+var retryableMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// retryableStatuses are the upstream statuses worth retrying; anything else
+// is either a client error or a success and shouldn't be retried.
+var retryableStatuses = map[int]bool{
+	http.StatusBadGateway:     true,
+	http.StatusGatewayTimeout: true,
+}
+
+// dialedAddrKey is the context key retryRoundTripper uses to learn which
+// addr a given attempt actually dialed, so that a failed attempt only marks
+// that addr's dialer as failed rather than whichever dialer a concurrent
+// retry on some other request happens to be using at the same moment.
+type dialedAddrKey struct{}
+
+// dialedAddr is stashed in a request's context, one per attempt, and filled
+// in by the Transport's DialContext once it knows which addr it dialed.
+type dialedAddr struct {
+	addr string
+}
+
+// withDialedAddrTracking returns a copy of req whose context a DialContext
+// func can use to report back which addr it dialed for this specific
+// attempt, via recordDialedAddr.
+func withDialedAddrTracking(req *http.Request) (*http.Request, *dialedAddr) {
+	d := &dialedAddr{}
+	return req.WithContext(context.WithValue(req.Context(), dialedAddrKey{}, d)), d
+}
+
+// recordDialedAddr records addr as the one dialed for ctx, if ctx came from
+// withDialedAddrTracking. It's a no-op otherwise, so Transports that don't
+// care about retry bookkeeping can call it unconditionally.
+func recordDialedAddr(ctx context.Context, addr string) {
+	if d, ok := ctx.Value(dialedAddrKey{}).(*dialedAddr); ok {
+		d.addr = addr
+	}
+}
+
+// retryTripperware retries idempotent requests that fail with a network
+// error or a retryable 5xx status, using exponential backoff with jitter.
+// failed, if non-nil, is called with the addr that was dialed for the
+// failing attempt before each retry, so the balancer can be told to stop
+// favoring that specific dialer rather than whichever one a concurrent
+// retry on some unrelated request happens to be using.
+func retryTripperware(failed func(addr string)) Tripperware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &retryRoundTripper{orig: rt, failed: failed}
+	}
+}
+
+// retryRoundTripper wraps another http.RoundTripper and retries requests
+// that are safe to retry, giving up and returning whatever the last attempt
+// produced once it runs out of retries, time, or hits a non-retryable
+// response. errorRewritingRoundTripper (further out in the chain) is what
+// eventually turns a surviving error into a response.
+type retryRoundTripper struct {
+	orig   http.RoundTripper
+	failed func(addr string)
+}
+
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if !isRetryable(req) {
+		return rt.orig.RoundTrip(req)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = retryInitialInterval
+	b.Multiplier = retryMultiplier
+	b.RandomizationFactor = retryRandomizationFactor
+	b.MaxInterval = retryMaxInterval
+	b.MaxElapsedTime = retryMaxElapsedTime
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		attemptReq, dialed := withDialedAddrTracking(req)
+		resp, err = rt.orig.RoundTrip(attemptReq)
+		if !shouldRetry(resp, err) {
+			return resp, err
+		}
+		if attempt == maxRetries-1 {
+			// Out of attempts: hand the last result back untouched.
+			return resp, err
+		}
+
+		if rt.failed != nil {
+			rt.failed(dialed.addr)
+		}
+
+		wait := b.NextBackOff()
+		if wait == backoff.Stop {
+			return resp, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			// We're giving up and resp is never reaching the caller (a
+			// non-nil error means RoundTripper callers should ignore resp
+			// entirely), so it has to be drained and closed here or its
+			// connection leaks.
+			drainAndClose(resp)
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				// Also giving up here, same reasoning as above: resp never
+				// reaches the caller, so close it instead of leaking it.
+				drainAndClose(resp)
+				if err == nil {
+					err = bodyErr
+				}
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		// We're about to retry, which will overwrite resp on the next
+		// iteration. Drain and close the response we're discarding so
+		// net/http can reuse or release its connection instead of leaking
+		// it - the response returned on any of the paths above is handed
+		// to the caller, who's responsible for closing it themselves.
+		drainAndClose(resp)
+	}
+
+	return resp, err
+}
+
+func drainAndClose(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// isRetryable reports whether req is safe to send more than once: it's
+// either a method with no meaningful side effects, or it has a body we know
+// how to rewind.
+func isRetryable(req *http.Request) bool {
+	if retryableMethods[req.Method] {
+		return true
+	}
+	return req.GetBody != nil
+}
+
+// shouldRetry reports whether the result of a RoundTrip attempt is worth
+// retrying.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return retryableStatuses[resp.StatusCode]
+}
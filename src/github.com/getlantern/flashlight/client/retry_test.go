@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		getBody bool
+		want    bool
+	}{
+		{"get", http.MethodGet, false, true},
+		{"head", http.MethodHead, false, true},
+		{"options", http.MethodOptions, false, true},
+		{"post without rewindable body", http.MethodPost, false, false},
+		{"post with rewindable body", http.MethodPost, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com", nil)
+			if tt.getBody {
+				req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+			}
+			if got := isRetryable(req); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{"network error", nil, errors.New("boom"), true},
+		{"bad gateway", &http.Response{StatusCode: http.StatusBadGateway}, nil, true},
+		{"gateway timeout", &http.Response{StatusCode: http.StatusGatewayTimeout}, nil, true},
+		{"ok", &http.Response{StatusCode: http.StatusOK}, nil, false},
+		{"not found", &http.Response{StatusCode: http.StatusNotFound}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRetry(tt.resp, tt.err); got != tt.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// scriptedRoundTripper replays a fixed sequence of responses/errors, one per
+// call, and counts how many times RoundTrip was invoked.
+type scriptedRoundTripper struct {
+	attempts int
+	errs     []error
+}
+
+func (rt *scriptedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := rt.attempts
+	rt.attempts++
+	if i < len(rt.errs) && rt.errs[i] != nil {
+		return nil, rt.errs[i]
+	}
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestRetryRoundTripperSucceedsWithoutRetry(t *testing.T) {
+	orig := &scriptedRoundTripper{}
+	var failedCalls int
+	rt := &retryRoundTripper{orig: orig, failed: func(addr string) { failedCalls++ }}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if orig.attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", orig.attempts)
+	}
+	if failedCalls != 0 {
+		t.Fatalf("expected failed hook not to be called, got %d calls", failedCalls)
+	}
+}
+
+// closeTrackingBody records whether Close was called on it, so tests can
+// verify a discarded response's body was actually released.
+type closeTrackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeTrackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+// statusScriptedRoundTripper replays a fixed sequence of status codes, each
+// with its own trackable body, and counts how many times it was called.
+type statusScriptedRoundTripper struct {
+	attempts int
+	bodies   []*closeTrackingBody
+	statuses []int
+}
+
+func (rt *statusScriptedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := rt.attempts
+	rt.attempts++
+	body := &closeTrackingBody{Reader: strings.NewReader("body")}
+	rt.bodies = append(rt.bodies, body)
+	return &http.Response{StatusCode: rt.statuses[i], Body: body}, nil
+}
+
+func TestRetryRoundTripperClosesDiscardedResponseBody(t *testing.T) {
+	orig := &statusScriptedRoundTripper{statuses: []int{http.StatusBadGateway, http.StatusOK}}
+	rt := &retryRoundTripper{orig: orig}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(orig.bodies) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(orig.bodies))
+	}
+	if !orig.bodies[0].closed {
+		t.Fatalf("expected the discarded 502 response's body to be closed")
+	}
+	if orig.bodies[1].closed {
+		t.Fatalf("the final, returned response's body should be left open for the caller to close")
+	}
+}
+
+func TestRetryRoundTripperClosesResponseBodyOnContextCancellation(t *testing.T) {
+	orig := &statusScriptedRoundTripper{statuses: []int{
+		http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway,
+	}}
+	rt := &retryRoundTripper{orig: orig}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil).WithContext(ctx)
+
+	resp, err := rt.RoundTrip(req)
+	if resp != nil {
+		t.Fatalf("expected a nil response once the context is cancelled, got %v", resp)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if len(orig.bodies) != 1 {
+		t.Fatalf("expected to give up after the first attempt's backoff wait, got %d attempts", len(orig.bodies))
+	}
+	if !orig.bodies[0].closed {
+		t.Fatalf("expected the abandoned 502 response's body to be closed")
+	}
+}
+
+func TestRetryRoundTripperRetriesOnNetworkErrorThenSucceeds(t *testing.T) {
+	orig := &scriptedRoundTripper{errs: []error{errors.New("connection refused")}}
+	var failedCalls int
+	rt := &retryRoundTripper{orig: orig, failed: func(addr string) { failedCalls++ }}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if orig.attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", orig.attempts)
+	}
+	if failedCalls != 1 {
+		t.Fatalf("expected failed hook to be called once, got %d calls", failedCalls)
+	}
+}
+
+// addrRecordingRoundTripper simulates a Transport whose DialContext calls
+// recordDialedAddr, so tests can verify retryRoundTripper threads the
+// per-attempt addr through to the failed hook correctly.
+type addrRecordingRoundTripper struct {
+	addrs []string // addr to report dialed on each successive attempt
+	calls int
+}
+
+func (rt *addrRecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := rt.addrs[rt.calls%len(rt.addrs)]
+	recordDialedAddr(req.Context(), addr)
+	rt.calls++
+	return nil, errors.New("connection refused")
+}
+
+func TestRetryRoundTripperPassesDialedAddrToFailedHook(t *testing.T) {
+	orig := &addrRecordingRoundTripper{addrs: []string{"10.0.0.1:80"}}
+	var failedAddrs []string
+	rt := &retryRoundTripper{orig: orig, failed: func(addr string) { failedAddrs = append(failedAddrs, addr) }}
+
+	// Cancel during the first attempt's backoff wait so the loop stops after
+	// exactly one attempt, the same way TestRetryRoundTripperHonorsContextCancellation does.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil).WithContext(ctx)
+
+	rt.RoundTrip(req)
+
+	if len(failedAddrs) != 1 || failedAddrs[0] != "10.0.0.1:80" {
+		t.Fatalf("expected failed hook called once with the dialed addr, got %v", failedAddrs)
+	}
+}
+
+func TestRetryRoundTripperHonorsContextCancellation(t *testing.T) {
+	orig := &scriptedRoundTripper{errs: []error{
+		errors.New("boom"), errors.New("boom"), errors.New("boom"), errors.New("boom"),
+	}}
+	rt := &retryRoundTripper{orig: orig}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil).WithContext(ctx)
+	_, err := rt.RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if orig.attempts != 1 {
+		t.Fatalf("expected to give up after the first attempt's backoff wait, got %d attempts", orig.attempts)
+	}
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/detour"
+)
+
+const (
+	defaultQOS = 0
+
+	// maxPoolEntries bounds how many distinct (qos, ProxyAll) ReverseProxies
+	// we keep alive at once, so a site that sends bogus X-Lantern-QOS values
+	// can't make us leak a transport (and its idle connections) forever.
+	maxPoolEntries = 32
+
+	// poolIdleConnTimeout is how long a pooled ReverseProxy's transport will
+	// keep an idle connection open.
+	poolIdleConnTimeout = 90 * time.Second
+)
+
+// QOSPolicy, if set, is consulted to decide which QoS level an HTTP request
+// should be served at. It takes precedence over the X-Lantern-QOS header.
+// Embedders (desktop UI, mobile bindings, CLI) register it to drive QoS from
+// their own rules rather than a header.
+var QOSPolicy func(req *http.Request) int
+
+// qosForRequest determines the QoS level a request should be dialed at.
+func qosForRequest(req *http.Request) int {
+	if QOSPolicy != nil {
+		return QOSPolicy(req)
+	}
+	if header := req.Header.Get("X-Lantern-QOS"); header != "" {
+		if qos, err := strconv.Atoi(header); err == nil {
+			return qos
+		}
+	}
+	return defaultQOS
+}
+
+// poolKey identifies one cached ReverseProxy. ProxyAll changes which dialer
+// (bal.DialQOS directly, or wrapped in detour.Dialer) a ReverseProxy was
+// built with, so it has to be part of the key.
+type poolKey struct {
+	qos      int
+	proxyAll bool
+}
+
+// reverseProxyPool lazily builds and caches a *httputil.ReverseProxy per QoS
+// level, so that requests asking for a particular QoS actually get it.
+// httputil.ReverseProxy reuses http.Transport connections across requests,
+// so a single shared ReverseProxy can only honor the QoS of whichever
+// request happened to open each connection; a pool gives every QoS level
+// its own transport instead.
+type reverseProxyPool struct {
+	client *Client
+
+	mu      sync.Mutex
+	entries map[poolKey]*httputil.ReverseProxy
+	lru     []poolKey // least-recently-used first
+}
+
+func (client *Client) newReverseProxyPool() *reverseProxyPool {
+	return &reverseProxyPool{
+		client:  client,
+		entries: make(map[poolKey]*httputil.ReverseProxy),
+	}
+}
+
+// get returns the ReverseProxy for the given QoS level, building and caching
+// it if necessary.
+func (p *reverseProxyPool) get(qos int) *httputil.ReverseProxy {
+	key := poolKey{qos: qos, proxyAll: p.client.ProxyAll()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rp, ok := p.entries[key]
+	if !ok {
+		rp = p.client.newReverseProxyQOS(qos)
+		p.entries[key] = rp
+		p.evictLocked()
+	}
+	p.touchLocked(key)
+	return rp
+}
+
+func (p *reverseProxyPool) touchLocked(key poolKey) {
+	for i, k := range p.lru {
+		if k == key {
+			p.lru = append(p.lru[:i], p.lru[i+1:]...)
+			break
+		}
+	}
+	p.lru = append(p.lru, key)
+}
+
+// evictLocked drops the least-recently-used entry once the pool grows past
+// maxPoolEntries.
+func (p *reverseProxyPool) evictLocked() {
+	for len(p.lru) >= maxPoolEntries {
+		oldest := p.lru[0]
+		p.lru = p.lru[1:]
+		delete(p.entries, oldest)
+	}
+}
+
+// reset discards every cached ReverseProxy. The client calls this whenever
+// the balancer changes (for example on a config reload) so that stale
+// dialers can never be reused.
+func (p *reverseProxyPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.entries = make(map[poolKey]*httputil.ReverseProxy)
+	p.lru = nil
+}
+
+// newReverseProxyQOS builds the ReverseProxy for one pool entry, dialing
+// through the balancer at the given QoS level via bal.DialQOS.
+func (client *Client) newReverseProxyQOS(qos int) *httputil.ReverseProxy {
+	bal := client.getBalancer()
+
+	dial := func(network, addr string) (net.Conn, error) {
+		return bal.DialQOS(network, addr, qos)
+	}
+
+	transport := &http.Transport{
+		TLSHandshakeTimeout: 40 * time.Second,
+		IdleConnTimeout:     poolIdleConnTimeout,
+	}
+	if !client.ProxyAll() {
+		dial = detour.Dialer(dial)
+	}
+	// DialContext (rather than Dial) lets retryTripperware learn which addr
+	// each attempt actually dialed, via recordDialedAddr, so a failed
+	// attempt only marks that addr's dialer as failed.
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		recordDialedAddr(ctx, addr)
+		return dial(network, addr)
+	}
+
+	// client.tripperwares has to sit between the header-injecting
+	// tripperwares and retryTripperware: retryTripperware is innermost,
+	// closest to the transport, so the header injectors above it run once
+	// per logical request rather than once per retry attempt. User
+	// tripperwares registered via Use belong outside retryTripperware for
+	// the same reason - otherwise they'd re-run on every retry attempt too.
+	withUserTripperwares := append([]Tripperware{
+		errorRewritingTripperware(client),
+		headerDumpTripperware(false),
+		deviceIDTripperware(client.DeviceID),
+		authTokenTripperware(bal.AllAuthTokens()),
+	}, client.tripperwares...)
+	builtins := append(withUserTripperwares, retryTripperware(func(addr string) {
+		bal.MarkFailed(addr)
+	}))
+
+	rp := &httputil.ReverseProxy{
+		Director:  func(req *http.Request) {},
+		Transport: chainTripperware(transport, builtins...),
+		// Set a FlushInterval to prevent overly aggressive buffering of
+		// responses, which helps keep memory usage down
+		FlushInterval: 250 * time.Millisecond,
+		ErrorLog:      log.AsStdLogger(),
+	}
+	// When the embedder has registered an ErrorHandler, errorRewritingRoundTripper
+	// (above) lets the *UpstreamError propagate instead of rendering our own
+	// page, so ReverseProxy's standard library machinery delivers it here.
+	if client.ErrorHandler != nil {
+		rp.ErrorHandler = client.ErrorHandler
+	}
+	return rp
+}
+
+// reverseProxies returns the client's per-QoS pool of reverse proxies,
+// creating it on first use.
+func (client *Client) reverseProxies() *reverseProxyPool {
+	client.proxyPoolOnce.Do(func() {
+		client.proxyPool = client.newReverseProxyPool()
+	})
+	return client.proxyPool
+}
+
+// invalidateReverseProxies discards every pooled ReverseProxy. It must be
+// called whenever the balancer is rebuilt (e.g. on a config reload), since
+// each pooled ReverseProxy's transport is bound to the old balancer's
+// dialer.
+func (client *Client) invalidateReverseProxies() {
+	client.reverseProxies().reset()
+}
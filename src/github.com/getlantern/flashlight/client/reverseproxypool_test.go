@@ -0,0 +1,105 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"reflect"
+	"testing"
+)
+
+func newTestPool() *reverseProxyPool {
+	return &reverseProxyPool{entries: make(map[poolKey]*httputil.ReverseProxy)}
+}
+
+func TestReverseProxyPoolTouchLockedMovesKeyToEnd(t *testing.T) {
+	p := newTestPool()
+	a, b, c := poolKey{qos: 1}, poolKey{qos: 2}, poolKey{qos: 3}
+
+	p.touchLocked(a)
+	p.touchLocked(b)
+	p.touchLocked(c)
+	p.touchLocked(a) // re-touching a should move it to the end, not duplicate it
+
+	want := []poolKey{b, c, a}
+	if !reflect.DeepEqual(p.lru, want) {
+		t.Fatalf("lru = %v, want %v", p.lru, want)
+	}
+}
+
+func TestReverseProxyPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	p := newTestPool()
+
+	for i := 0; i < maxPoolEntries+5; i++ {
+		key := poolKey{qos: i}
+		p.entries[key] = &httputil.ReverseProxy{}
+		p.touchLocked(key)
+		p.evictLocked()
+	}
+
+	if len(p.entries) > maxPoolEntries {
+		t.Fatalf("expected no more than %d entries after eviction, got %d", maxPoolEntries, len(p.entries))
+	}
+	if len(p.lru) != len(p.entries) {
+		t.Fatalf("lru (%d) and entries (%d) should always track the same set", len(p.lru), len(p.entries))
+	}
+	if _, ok := p.entries[poolKey{qos: 0}]; ok {
+		t.Fatalf("expected the oldest entry (qos=0) to have been evicted")
+	}
+	if _, ok := p.entries[poolKey{qos: maxPoolEntries + 4}]; !ok {
+		t.Fatalf("expected the most recently added entry to still be present")
+	}
+}
+
+func TestReverseProxyPoolTouchingDoesNotTriggerEviction(t *testing.T) {
+	p := newTestPool()
+	key := poolKey{qos: 1}
+	p.entries[key] = &httputil.ReverseProxy{}
+
+	for i := 0; i < maxPoolEntries*2; i++ {
+		p.touchLocked(key)
+		p.evictLocked()
+	}
+
+	if _, ok := p.entries[key]; !ok {
+		t.Fatalf("repeatedly touching the same key should not evict it")
+	}
+	if len(p.lru) != 1 {
+		t.Fatalf("expected lru to contain exactly one entry, got %d", len(p.lru))
+	}
+}
+
+func TestReverseProxyPoolReset(t *testing.T) {
+	p := newTestPool()
+	p.entries[poolKey{qos: 1}] = &httputil.ReverseProxy{}
+	p.touchLocked(poolKey{qos: 1})
+
+	p.reset()
+
+	if len(p.entries) != 0 {
+		t.Fatalf("expected entries to be empty after reset, got %d", len(p.entries))
+	}
+	if len(p.lru) != 0 {
+		t.Fatalf("expected lru to be empty after reset, got %d", len(p.lru))
+	}
+}
+
+func TestQOSForRequestDefaultsAndHeader(t *testing.T) {
+	QOSPolicy = nil
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if qos := qosForRequest(req); qos != defaultQOS {
+		t.Fatalf("qosForRequest() = %d, want default %d", qos, defaultQOS)
+	}
+
+	req.Header.Set("X-Lantern-QOS", "5")
+	if qos := qosForRequest(req); qos != 5 {
+		t.Fatalf("qosForRequest() = %d, want 5", qos)
+	}
+
+	QOSPolicy = func(req *http.Request) int { return 9 }
+	defer func() { QOSPolicy = nil }()
+	if qos := qosForRequest(req); qos != 9 {
+		t.Fatalf("qosForRequest() with QOSPolicy set = %d, want 9", qos)
+	}
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/status"
+)
+
+// Tripperware wraps an http.RoundTripper with additional behavior, producing
+// a new http.RoundTripper. It's the RoundTripper analogue of HTTP
+// middleware.
+type Tripperware func(http.RoundTripper) http.RoundTripper
+
+// Use registers one or more tripperwares to be folded, in order, over the
+// RoundTripper that backs the client's reverse proxy. Tripperwares
+// registered earlier end up outermost in the resulting chain, so they see a
+// request first and a response last. Use lets callers add behavior -
+// metrics, tracing, response caching, censorship-fingerprint detection -
+// without forking newReverseProxy.
+func (client *Client) Use(tripperwares ...Tripperware) {
+	client.tripperwares = append(client.tripperwares, tripperwares...)
+}
+
+// chainTripperware folds tripperwares over base so that the first
+// tripperware in the slice ends up outermost.
+func chainTripperware(base http.RoundTripper, tripperwares ...Tripperware) http.RoundTripper {
+	rt := base
+	for i := len(tripperwares) - 1; i >= 0; i-- {
+		rt = tripperwares[i](rt)
+	}
+	return rt
+}
+
+// authTokenTripperware sets the X-LANTERN-AUTH-TOKEN header for every auth
+// token the balancer knows about, since we don't know in advance which
+// upstream server the dialer will actually pick.
+func authTokenTripperware(authTokens []string) Tripperware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			for _, authToken := range authTokens {
+				req.Header.Add("X-LANTERN-AUTH-TOKEN", authToken)
+			}
+			return rt.RoundTrip(req)
+		})
+	}
+}
+
+// deviceIDTripperware sets the X-LANTERN-DEVICE-ID header and strips the
+// X-Forwarded-For header that httputil.ReverseProxy adds, which confuses
+// upstream servers trying to determine the client's real IP.
+func deviceIDTripperware(deviceID string) Tripperware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Del("X-Forwarded-For")
+			req.Header.Set("X-LANTERN-DEVICE-ID", deviceID)
+			return rt.RoundTrip(req)
+		})
+	}
+}
+
+// headerDumpTripperware dumps request and response headers to the log when
+// shouldDumpHeaders is true, and is a no-op otherwise.
+func headerDumpTripperware(shouldDumpHeaders bool) Tripperware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if !shouldDumpHeaders {
+			return rt
+		}
+		return &headerDumpingRoundTripper{rt}
+	}
+}
+
+// headerDumpingRoundTripper is an http.RoundTripper that wraps another
+// http.RoundTripper and dumps request and response headers to the log.
+type headerDumpingRoundTripper struct {
+	orig http.RoundTripper
+}
+
+func (rt *headerDumpingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	proxy.DumpHeaders("Request", &req.Header)
+	resp, err = rt.orig.RoundTrip(req)
+	if err == nil {
+		proxy.DumpHeaders("Response", &resp.Header)
+	}
+	return
+}
+
+// errorRewritingTripperware creates the special *http.Response used when the
+// underlying RoundTripper fails for some reason, unless client has an
+// ErrorHandler registered, in which case it lets the error propagate so
+// httputil.ReverseProxy's own ErrorHandler machinery can take over.
+func errorRewritingTripperware(client *Client) Tripperware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &errorRewritingRoundTripper{orig: rt, client: client}
+	}
+}
+
+// errorRewritingRoundTripper wraps another http.RoundTripper and turns any
+// error it returns into an *http.Response, so that callers that don't know
+// how to handle a RoundTrip error (like httputil.ReverseProxy) still show
+// the user something. When client.ErrorHandler is set, the error is instead
+// returned as an *UpstreamError and no response is built.
+type errorRewritingRoundTripper struct {
+	orig   http.RoundTripper
+	client *Client
+}
+
+func (er *errorRewritingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	res, err := er.orig.RoundTrip(req)
+	if err != nil {
+		uerr := newUpstreamError(err)
+
+		if er.client.ErrorHandler != nil {
+			// Hand off to the ErrorHandler registered with the
+			// httputil.ReverseProxy in newReverseProxyQOS instead of
+			// rendering our own page.
+			return nil, uerr
+		}
+
+		var htmlerr []byte
+
+		// If the request has an 'Accept' header preferring HTML, or
+		// doesn't have that header at all, render the error page.
+		switch req.Header.Get("Accept") {
+		case "text/html":
+			fallthrough
+		case "application/xhtml+xml":
+			fallthrough
+		case "":
+			// It is likely we will have lots of different errors to handle but for now
+			// we will only return a ErrorAccessingPage error.  This prevents the user
+			// from getting just a blank screen.
+			htmlerr, err = status.ErrorAccessingPage(req.Host, uerr.Err)
+			if err != nil {
+				log.Debugf("Got error while generating status page: %q", err)
+			}
+		default:
+			// We know for sure that the requested resource is not HTML page,
+			// wrap the error message in http content, or http.ReverseProxy
+			// will response 500 Internal Server Error instead.
+			htmlerr = []byte(uerr.Error())
+		}
+
+		// status.ErrorAccessingPage's signature doesn't carry the
+		// classified reason into the rendered page, so surface it via a
+		// response header instead - anything downstream (extensions, the
+		// desktop UI's network inspector) that wants to show something more
+		// actionable than "site unavailable" can read it from there.
+		log.Debugf("Rewriting error for %v as HTTP %d (%s): %v", req.Host, uerr.StatusCode, uerr.Reason, uerr.Err)
+		res = &http.Response{
+			Header: http.Header{errorReasonHeader: []string{uerr.Reason}},
+			Body:   ioutil.NopCloser(bytes.NewBuffer(htmlerr)),
+		}
+		res.StatusCode = uerr.StatusCode
+		return res, nil
+	}
+	return res, err
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface,
+// analogous to http.HandlerFunc.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
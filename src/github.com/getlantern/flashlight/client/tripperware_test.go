@@ -0,0 +1,145 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// errServerRefused classifies as classBadGateway via classifyUpstreamError's
+// substring matching, same as a real dial failure would.
+var errServerRefused = errors.New("connection refused")
+
+// orderRecordingTripperware appends name to order when the request passes
+// through it, on both the way in and the way back out, so tests can assert
+// on the actual call order rather than just the final result.
+func orderRecordingTripperware(name string, order *[]string) Tripperware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			*order = append(*order, name+":in")
+			resp, err := rt.RoundTrip(req)
+			*order = append(*order, name+":out")
+			return resp, err
+		})
+	}
+}
+
+func TestChainTripperwareOrdersOutermostFirst(t *testing.T) {
+	var order []string
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		order = append(order, "base")
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	rt := chainTripperware(base,
+		orderRecordingTripperware("first", &order),
+		orderRecordingTripperware("second", &order),
+		orderRecordingTripperware("third", &order),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+
+	want := []string{
+		"first:in", "second:in", "third:in",
+		"base",
+		"third:out", "second:out", "first:out",
+	}
+	if len(order) != len(want) {
+		t.Fatalf("call order = %v, want %v", order, want)
+	}
+	for i, name := range want {
+		if order[i] != name {
+			t.Fatalf("call order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestAuthTokenTripperwareAddsOneHeaderPerToken(t *testing.T) {
+	var gotReq *http.Request
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	rt := authTokenTripperware([]string{"tok1", "tok2"})(base)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+
+	got := gotReq.Header.Values("X-LANTERN-AUTH-TOKEN")
+	want := []string{"tok1", "tok2"}
+	if len(got) != len(want) {
+		t.Fatalf("X-LANTERN-AUTH-TOKEN values = %v, want %v", got, want)
+	}
+	for i, tok := range want {
+		if got[i] != tok {
+			t.Fatalf("X-LANTERN-AUTH-TOKEN values = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDeviceIDTripperwareSetsHeaderAndStripsForwardedFor(t *testing.T) {
+	var gotReq *http.Request
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	rt := deviceIDTripperware("device-123")(base)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+
+	if got := gotReq.Header.Get("X-LANTERN-DEVICE-ID"); got != "device-123" {
+		t.Fatalf("X-LANTERN-DEVICE-ID = %q, want %q", got, "device-123")
+	}
+	if got := gotReq.Header.Get("X-Forwarded-For"); got != "" {
+		t.Fatalf("expected X-Forwarded-For to be stripped, got %q", got)
+	}
+}
+
+func TestErrorRewritingRoundTripperHandsOffToErrorHandler(t *testing.T) {
+	client := &Client{ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {}}
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errServerRefused
+	})
+
+	rt := errorRewritingTripperware(client)(base)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, err := rt.RoundTrip(req)
+
+	uerr, ok := err.(*UpstreamError)
+	if !ok {
+		t.Fatalf("expected *UpstreamError when client.ErrorHandler is set, got %v (%T)", err, err)
+	}
+	if uerr.Reason != classBadGateway.reason {
+		t.Fatalf("Reason = %q, want %q", uerr.Reason, classBadGateway.reason)
+	}
+}
+
+func TestErrorRewritingRoundTripperRendersDefaultPageWithReasonHeader(t *testing.T) {
+	client := &Client{}
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errServerRefused
+	})
+
+	rt := errorRewritingTripperware(client)(base)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	if resp.StatusCode != classBadGateway.status {
+		t.Fatalf("StatusCode = %d, want %d", resp.StatusCode, classBadGateway.status)
+	}
+	if got := resp.Header.Get(errorReasonHeader); got != classBadGateway.reason {
+		t.Fatalf("%s header = %q, want %q", errorReasonHeader, got, classBadGateway.reason)
+	}
+}
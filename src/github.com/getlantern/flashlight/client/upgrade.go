@@ -0,0 +1,180 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/detour"
+	"github.com/getlantern/flashlight/status"
+)
+
+// errNoHijack is returned when the ResponseWriter handling an upgrade
+// request doesn't support hijacking its underlying connection, which
+// shouldn't happen for the net/http server we run but is worth guarding
+// against explicitly rather than panicking.
+var errNoHijack = errors.New("response writer does not support hijacking")
+
+// isUpgradeRequest returns whether req is asking to switch protocols on the
+// underlying connection (WebSockets, HTTP/2 h2c, SPDY-style tunnels) rather
+// than complete a normal request/response cycle. httputil.ReverseProxy
+// doesn't know how to keep a connection alive past its first response, so
+// these have to be handled separately.
+func isUpgradeRequest(req *http.Request) bool {
+	for _, token := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// newUpgradeAwareHandler creates an http.Handler that dials the upstream
+// picked by the client's balancer, hijacks the client connection and then
+// pipes bytes directly between the two, bypassing httputil.ReverseProxy
+// entirely. It injects the same auth tokens and device-ID header that the
+// deviceIDTripperware/authTokenTripperware tripperwares add for the
+// non-upgrade path, since the upstream still needs to authenticate the
+// request.
+//
+// Unlike the pooled ReverseProxies, there's nothing here to invalidate on a
+// config reload: the balancer and auth tokens are looked up fresh for every
+// request, and the request's QoS (via qosForRequest) picks the dialer, same
+// as the non-upgrade path.
+func (client *Client) newUpgradeAwareHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bal := client.getBalancer()
+		qos := qosForRequest(req)
+
+		dial := func(network, addr string) (net.Conn, error) {
+			return bal.DialQOS(network, addr, qos)
+		}
+		if !client.ProxyAll() {
+			dial = detour.Dialer(dial)
+		}
+
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Set("X-LANTERN-DEVICE-ID", client.DeviceID)
+		for _, authToken := range bal.AllAuthTokens() {
+			req.Header.Add("X-LANTERN-AUTH-TOKEN", authToken)
+		}
+
+		upstream, err := dial("tcp", upgradeDialAddr(req))
+		if err != nil {
+			client.respondUpgradeError(w, req, err)
+			return
+		}
+		defer upstream.Close()
+
+		if err := req.Write(upstream); err != nil {
+			client.respondUpgradeError(w, req, err)
+			return
+		}
+
+		upstreamReader := bufio.NewReader(upstream)
+		resp, err := http.ReadResponse(upstreamReader, req)
+		if err != nil {
+			client.respondUpgradeError(w, req, err)
+			return
+		}
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			client.respondUpgradeError(w, req, errNoHijack)
+			return
+		}
+		conn, bufrw, err := hj.Hijack()
+		if err != nil {
+			client.respondUpgradeError(w, req, err)
+			return
+		}
+		defer conn.Close()
+
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			// Upstream refused the upgrade; its response has been relayed.
+			return
+		}
+
+		// Hijack can hand back bytes the net/http server already buffered
+		// off the client socket while parsing the upgrade request - e.g.
+		// frames the client pipelined right after the handshake. Those have
+		// to be replayed to upstream before we start blindly copying conn,
+		// or they're silently lost.
+		var clientReader io.Reader = conn
+		if bufrw != nil && bufrw.Reader.Buffered() > 0 {
+			clientReader = io.MultiReader(bufrw.Reader, conn)
+		}
+
+		// The handshake succeeded, so from here on this is just a raw pipe.
+		// Neither side should have read or write deadlines applied to it;
+		// a WebSocket or h2c connection is expected to sit idle for long
+		// stretches between frames.
+		done := make(chan struct{}, 2)
+		go copyUpgradeConn(done, upstream, clientReader)
+		go copyUpgradeConn(done, conn, upstream)
+		<-done
+	})
+}
+
+// upgradeDialAddr computes the host:port to dial for req the same way
+// http.Transport does internally before an ordinary request ever reaches a
+// Dial func: req.Host/req.URL.Host usually omit the port for the default
+// scheme, but the balancer's dialers require an explicit one.
+func upgradeDialAddr(req *http.Request) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if req.TLS != nil || req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func copyUpgradeConn(done chan<- struct{}, dst io.Writer, src io.Reader) {
+	io.Copy(dst, src)
+	done <- struct{}{}
+}
+
+// respondUpgradeError renders err the same way errorRewritingRoundTripper
+// does for ordinary requests, since a failed upgrade (the dial failed, the
+// upstream's response couldn't be read, etc.) is just as user-visible as a
+// failed page load. A non-101 response from upstream is relayed to the
+// client as is rather than rendered here. If the client has an ErrorHandler registered, it's given the chance
+// to render the error instead of the default HTML page.
+func (client *Client) respondUpgradeError(w http.ResponseWriter, req *http.Request, err error) {
+	uerr := newUpstreamError(err)
+
+	if client.ErrorHandler != nil {
+		client.ErrorHandler(w, req, uerr)
+		return
+	}
+
+	// status.ErrorAccessingPage's signature doesn't carry the classified
+	// reason into the rendered page, so surface it via a response header
+	// instead, the same way errorRewritingRoundTripper does for the
+	// non-upgrade path.
+	w.Header().Set(errorReasonHeader, uerr.Reason)
+
+	switch req.Header.Get("Accept") {
+	case "text/html", "application/xhtml+xml", "":
+		htmlerr, statusErr := status.ErrorAccessingPage(req.Host, uerr.Err)
+		if statusErr != nil {
+			log.Debugf("Got error while generating status page: %q", statusErr)
+		}
+		w.WriteHeader(uerr.StatusCode)
+		w.Write(htmlerr)
+	default:
+		http.Error(w, uerr.Error(), uerr.StatusCode)
+	}
+}